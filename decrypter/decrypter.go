@@ -0,0 +1,365 @@
+// Package decrypter decrypts HLS segment payloads encrypted under
+// METHOD=AES-128 (the whole TS packet stream) or METHOD=SAMPLE-AES
+// (the PES payloads of the audio and video streams; see
+// DecryptSampleAES for which bytes of those payloads are decrypted).
+package decrypter
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
+)
+
+// Decrypt decrypts a full MPEG-TS segment encrypted with AES-128-CBC
+// and PKCS7 padding, as used by METHOD=AES-128.
+func Decrypt(data, key, iv []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(data)%aes.BlockSize != 0 {
+		return nil, errors.New("data is not a multiple of the AES block size")
+	}
+
+	out := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(out, data)
+
+	return unpad(out)
+}
+
+// DecryptSampleAES decrypts a METHOD=SAMPLE-AES segment. Unlike plain
+// AES-128, only the payload of each 188-byte TS packet is encrypted,
+// leaving TS headers and adaptation fields in the clear, so the packet
+// stream stays parseable without decrypting it first. Only the audio
+// and video elementary streams listed in the PMT are actually
+// encrypted; PAT, PMT and any other PSI/metadata PIDs are always sent
+// in the clear and must be left untouched, so we parse the PAT/PMT
+// first to find those PIDs before decrypting anything.
+//
+// A PES unit's payload is one continuous CBC-encrypted byte stream that
+// spans many consecutive TS packets sharing a PID, so the cipher state
+// has to carry across packet boundaries rather than resetting per
+// packet; resetting per packet (as if every packet were an independent
+// ciphertext) decrypts the first block of each packet correctly and
+// garbles the rest. Per PID, we run one cipher.BlockMode across the
+// whole unit, starting a fresh one (reseeded with iv, per the HLS spec)
+// at each payload_unit_start_indicator, and carry any sub-block
+// remainder forward to be completed by the next packet's payload.
+//
+// This still doesn't model Apple's finer-grained partial encryption
+// (only certain NALUs/frames within a unit are encrypted, with the rest
+// left clear); it treats every byte of every PES unit's payload on a
+// media PID as ciphertext, which is sufficient for the common case but
+// not a full SAMPLE-AES implementation.
+func DecryptSampleAES(data, key, iv []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	const packetSize = 188
+	if len(data)%packetSize != 0 {
+		return nil, errors.New("data is not a multiple of the TS packet size")
+	}
+
+	out := make([]byte, len(data))
+	copy(out, data)
+
+	mediaPIDs := findMediaPIDs(out, packetSize)
+
+	streams := map[uint16]*streamState{}
+
+	for i := 0; i+packetSize <= len(out); i += packetSize {
+		packet := out[i : i+packetSize]
+
+		pid, unitStart, ok := packetHeader(packet)
+		if !ok || !mediaPIDs[pid] {
+			continue
+		}
+
+		payload := samplePayload(packet)
+		if payload == nil {
+			continue
+		}
+
+		st := streams[pid]
+		if st == nil || unitStart {
+			st = &streamState{mode: cipher.NewCBCDecrypter(block, iv)}
+			streams[pid] = st
+		}
+
+		if unitStart {
+			// Skip the PES header, which is always in the clear.
+			hdrLen := len(payload)
+			if len(payload) >= 9 && 9+int(payload[8]) < hdrLen {
+				hdrLen = 9 + int(payload[8])
+			}
+			payload = payload[hdrLen:]
+		}
+
+		st.decrypt(payload)
+	}
+
+	return out, nil
+}
+
+const (
+	patPID = 0x0000
+
+	streamTypeMPEG1Video = 0x01
+	streamTypeMPEG2Video = 0x02
+	streamTypeMPEG1Audio = 0x03
+	streamTypeMPEG2Audio = 0x04
+	streamTypeAACADTS    = 0x0f
+	streamTypeAACLATM    = 0x11
+	streamTypeH264       = 0x1b
+	streamTypeHEVC       = 0x24
+	streamTypeAC3        = 0x81
+	streamTypeEAC3       = 0x87
+)
+
+// isMediaStreamType reports whether stream_type identifies an audio or
+// video elementary stream, as opposed to data/metadata carried in the
+// same program.
+func isMediaStreamType(streamType byte) bool {
+	switch streamType {
+	case streamTypeMPEG1Video, streamTypeMPEG2Video,
+		streamTypeMPEG1Audio, streamTypeMPEG2Audio,
+		streamTypeAACADTS, streamTypeAACLATM,
+		streamTypeH264, streamTypeHEVC,
+		streamTypeAC3, streamTypeEAC3:
+		return true
+	default:
+		return false
+	}
+}
+
+// findMediaPIDs scans data for the PAT and the PMT(s) it points to and
+// returns the set of PIDs carrying an audio or video elementary stream.
+// PAT and PMT sections are only ever sent in the clear and are assumed
+// to each fit in a single TS packet, which covers every HLS stream this
+// tool has been tested against.
+func findMediaPIDs(data []byte, packetSize int) map[uint16]bool {
+	pmtPIDs := map[uint16]bool{}
+	mediaPIDs := map[uint16]bool{}
+
+	for i := 0; i+packetSize <= len(data); i += packetSize {
+		packet := data[i : i+packetSize]
+
+		pid, unitStart, ok := packetHeader(packet)
+		if !ok || !unitStart {
+			continue
+		}
+
+		payload := samplePayload(packet)
+		if payload == nil {
+			continue
+		}
+
+		if pid == patPID {
+			for pmtPID := range parsePAT(payload) {
+				pmtPIDs[pmtPID] = true
+			}
+		}
+	}
+
+	for i := 0; i+packetSize <= len(data); i += packetSize {
+		packet := data[i : i+packetSize]
+
+		pid, unitStart, ok := packetHeader(packet)
+		if !ok || !unitStart || !pmtPIDs[pid] {
+			continue
+		}
+
+		payload := samplePayload(packet)
+		if payload == nil {
+			continue
+		}
+
+		for esPID := range parsePMT(payload) {
+			mediaPIDs[esPID] = true
+		}
+	}
+
+	return mediaPIDs
+}
+
+// psiSection strips the pointer_field prefix from a payload_unit_start
+// PSI payload and returns the section itself, bounded by its
+// section_length.
+func psiSection(payload []byte) []byte {
+	if len(payload) < 1 {
+		return nil
+	}
+	payload = payload[1+payload[0]:]
+	if len(payload) < 8 {
+		return nil
+	}
+
+	sectionLength := int(payload[1]&0x0f)<<8 | int(payload[2])
+	end := 3 + sectionLength
+	if end > len(payload) {
+		return nil
+	}
+
+	return payload[:end]
+}
+
+// parsePAT returns the set of program_map_PID values listed in a
+// Program Association Table section.
+func parsePAT(payload []byte) map[uint16]bool {
+	section := psiSection(payload)
+	if section == nil {
+		return nil
+	}
+
+	const (
+		headerLen = 8
+		crcLen    = 4
+		entryLen  = 4
+	)
+	if len(section) < headerLen+crcLen {
+		return nil
+	}
+
+	pmtPIDs := map[uint16]bool{}
+	for i := headerLen; i+entryLen <= len(section)-crcLen; i += entryLen {
+		programNumber := uint16(section[i])<<8 | uint16(section[i+1])
+		pid := (uint16(section[i+2]&0x1f) << 8) | uint16(section[i+3])
+		if programNumber != 0 {
+			pmtPIDs[pid] = true
+		}
+	}
+
+	return pmtPIDs
+}
+
+// parsePMT returns the set of elementary_PID values carrying an audio
+// or video stream, as listed in a Program Map Table section.
+func parsePMT(payload []byte) map[uint16]bool {
+	section := psiSection(payload)
+	if section == nil {
+		return nil
+	}
+
+	const (
+		headerLen = 12
+		crcLen    = 4
+	)
+	if len(section) < headerLen+crcLen {
+		return nil
+	}
+
+	programInfoLength := int(section[10]&0x0f)<<8 | int(section[11])
+	i := headerLen + programInfoLength
+
+	esPIDs := map[uint16]bool{}
+	for i+5 <= len(section)-crcLen {
+		streamType := section[i]
+		pid := (uint16(section[i+1]&0x1f) << 8) | uint16(section[i+2])
+		esInfoLength := int(section[i+3]&0x0f)<<8 | int(section[i+4])
+
+		if isMediaStreamType(streamType) {
+			esPIDs[pid] = true
+		}
+
+		i += 5 + esInfoLength
+	}
+
+	return esPIDs
+}
+
+// streamState tracks one PID's running CBC decryption across however
+// many TS packets its current PES unit spans. pending holds ciphertext
+// bytes carried over because they were too short to form a full AES
+// block when their packet arrived; pendingDst is where the decrypted
+// form of those bytes must be written once enough ciphertext has
+// accumulated — it points back into the earlier packet's own payload
+// slice in the segment buffer, since out is one contiguous allocation.
+type streamState struct {
+	mode       cipher.BlockMode
+	pending    []byte
+	pendingDst []byte
+}
+
+// decrypt feeds payload through st's running cipher, decrypting as many
+// whole AES blocks as are available across the carried-over pending
+// bytes and payload combined, writing the plaintext back to wherever
+// each byte came from, and carrying forward any leftover partial block
+// for the next packet to complete.
+func (st *streamState) decrypt(payload []byte) {
+	buf := append(append([]byte{}, st.pending...), payload...)
+
+	n := len(buf) - len(buf)%aes.BlockSize
+	if n > 0 {
+		st.mode.CryptBlocks(buf[:n], buf[:n])
+	}
+
+	pendingLen := len(st.pending)
+	if pendingLen > 0 {
+		written := pendingLen
+		if n < written {
+			written = n
+		}
+		copy(st.pendingDst, buf[:written])
+	}
+	if n > pendingLen {
+		copy(payload, buf[pendingLen:n])
+	}
+
+	st.pending = append([]byte{}, buf[n:]...)
+	st.pendingDst = payload[len(payload)-(len(buf)-n):]
+}
+
+// samplePayload returns the payload slice of a single TS packet, after
+// skipping the 4-byte header and any adaptation field.
+func samplePayload(packet []byte) []byte {
+	if len(packet) < 4 || packet[0] != 0x47 {
+		return nil
+	}
+
+	hasAdaptation := packet[3]&0x20 != 0
+	hasPayload := packet[3]&0x10 != 0
+	if !hasPayload {
+		return nil
+	}
+
+	offset := 4
+	if hasAdaptation {
+		if len(packet) < 5 {
+			return nil
+		}
+		offset += 1 + int(packet[4])
+	}
+	if offset >= len(packet) {
+		return nil
+	}
+
+	return packet[offset:]
+}
+
+// packetHeader parses the PID and payload_unit_start_indicator out of a
+// TS packet's 4-byte header.
+func packetHeader(packet []byte) (pid uint16, unitStart bool, ok bool) {
+	if len(packet) < 4 || packet[0] != 0x47 {
+		return 0, false, false
+	}
+
+	pid = (uint16(packet[1]&0x1f) << 8) | uint16(packet[2])
+	unitStart = packet[1]&0x40 != 0
+
+	return pid, unitStart, true
+}
+
+func unpad(data []byte) ([]byte, error) {
+	if len(data) == 0 {
+		return data, nil
+	}
+
+	padLen := int(data[len(data)-1])
+	if padLen == 0 || padLen > len(data) {
+		return nil, errors.New("invalid PKCS7 padding")
+	}
+
+	return data[:len(data)-padLen], nil
+}
@@ -0,0 +1,205 @@
+// Package joiner collects segments downloaded out of order and writes
+// them to an output file in sequence. Progress is tracked in a sidecar
+// checkpoint file (<out>.m3u8dl.json) so an interrupted download can be
+// resumed without redownloading completed segments.
+package joiner
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+)
+
+type segmentInfo struct {
+	Offset int64 `json:"offset"`
+	Length int   `json:"length"`
+}
+
+type checkpoint struct {
+	PlaylistHash string                 `json:"playlist_hash"`
+	Segments     map[int]segmentInfo    `json:"segments"`
+}
+
+// Joiner writes segments to outFile in order as they're handed to it
+// via Join, regardless of the order they complete in.
+type Joiner struct {
+	file *os.File
+	name string
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	pending map[int][]byte
+	done    map[int]bool
+	failed  map[int]error
+
+	checkpointPath string
+	checkpoint     checkpoint
+}
+
+// New opens outFile for writing from scratch, with no resume support.
+func New(outFile string) (*Joiner, error) {
+	j, _, err := NewResumable(outFile, "", true)
+	return j, err
+}
+
+// NewResumable opens outFile for writing and reuses the checkpoint left
+// by a previous run with the same playlistHash, unless force is set.
+// It returns the segment indices that are already complete and can be
+// skipped.
+func NewResumable(outFile, playlistHash string, force bool) (j *Joiner, completed []int, err error) {
+	checkpointPath := outFile + ".m3u8dl.json"
+
+	j = &Joiner{
+		name:           outFile,
+		pending:        map[int][]byte{},
+		done:           map[int]bool{},
+		failed:         map[int]error{},
+		checkpointPath: checkpointPath,
+		checkpoint:     checkpoint{PlaylistHash: playlistHash, Segments: map[int]segmentInfo{}},
+	}
+	j.cond = sync.NewCond(&j.mu)
+
+	flags := os.O_CREATE | os.O_WRONLY
+	if !force {
+		if data, err := ioutil.ReadFile(checkpointPath); err == nil {
+			var cp checkpoint
+			if err := json.Unmarshal(data, &cp); err == nil && cp.PlaylistHash == playlistHash {
+				j.checkpoint = cp
+				flags |= os.O_APPEND
+			}
+		}
+	}
+	if flags&os.O_APPEND == 0 {
+		flags |= os.O_TRUNC
+		os.Remove(checkpointPath)
+	}
+
+	file, err := os.OpenFile(outFile, flags, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+	j.file = file
+
+	for id := range j.checkpoint.Segments {
+		j.done[id] = true
+		completed = append(completed, id)
+	}
+
+	return j, completed, nil
+}
+
+// Name returns the output file path.
+func (j *Joiner) Name() string {
+	return j.name
+}
+
+// Join registers the downloaded bytes for segment id, to be flushed to
+// disk once every earlier segment has arrived.
+func (j *Joiner) Join(id int, data []byte) {
+	j.mu.Lock()
+	j.pending[id] = data
+	j.cond.Broadcast()
+	j.mu.Unlock()
+}
+
+// Fail marks segment id as permanently failed. Run will not wait on it
+// and will report it as an error once the file is otherwise complete.
+func (j *Joiner) Fail(id int, err error) {
+	j.mu.Lock()
+	j.failed[id] = err
+	j.cond.Broadcast()
+	j.mu.Unlock()
+}
+
+// Run blocks until segments 0..count-1 have each either arrived via
+// Join or been marked failed via Fail, flushing them to disk in order
+// as they become available. The file is only ever appended to, so once
+// a segment permanently fails, later segments are intentionally left
+// unwritten and not marked done even if they already downloaded
+// successfully: writing them would leave a gap at the failed segment's
+// offset that can't later be filled in without rewriting everything
+// after it, silently reordering the output. A retry redownloads and
+// appends them in order once the gap is filled. Run returns a combined
+// error listing any failed segment indices.
+func (j *Joiner) Run(count int) error {
+	defer j.file.Close()
+
+	offset, err := j.file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	var failedIDs []int
+	broken := false
+
+	for id := 0; id < count; id++ {
+		j.mu.Lock()
+		if j.done[id] {
+			info := j.checkpoint.Segments[id]
+			offset = info.Offset + int64(info.Length)
+			j.mu.Unlock()
+			continue
+		}
+
+		for j.pending[id] == nil && j.failed[id] == nil {
+			j.cond.Wait()
+		}
+
+		if j.failed[id] != nil {
+			failedIDs = append(failedIDs, id)
+			broken = true
+			j.mu.Unlock()
+			continue
+		}
+
+		data := j.pending[id]
+		delete(j.pending, id)
+		j.mu.Unlock()
+
+		if broken {
+			continue
+		}
+
+		n, err := j.file.Write(data)
+		if err != nil {
+			return err
+		}
+
+		j.checkpoint.Segments[id] = segmentInfo{Offset: offset, Length: n}
+		offset += int64(n)
+		j.done[id] = true
+
+		if err := j.saveCheckpoint(); err != nil {
+			return err
+		}
+	}
+
+	if len(failedIDs) > 0 {
+		return fmt.Errorf("%d segment(s) failed: %v", len(failedIDs), failedIDs)
+	}
+
+	return os.Remove(j.checkpointPath)
+}
+
+func (j *Joiner) saveCheckpoint() error {
+	data, err := json.Marshal(j.checkpoint)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(j.checkpointPath, data, 0644)
+}
+
+// HashPlaylist returns a stable identifier for an ordered list of
+// segment URIs, used to make sure a checkpoint is only reused for the
+// playlist it was created for.
+func HashPlaylist(uris []string) string {
+	h := sha256.New()
+	h.Write([]byte(strings.Join(uris, "\n")))
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,266 @@
+// Package livedl implements rolling capture of a live HLS stream: it
+// polls the media playlist on an interval derived from TargetDuration,
+// keeps a sliding window of recently-seen segment URIs to avoid
+// re-downloading them, and appends newly-seen segments to the output
+// file in arrival order until EXT-X-ENDLIST appears or a duration
+// budget elapses.
+package livedl
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/grafov/m3u8"
+
+	"m3u8-downloader-go/decrypter"
+	"m3u8-downloader-go/zhttp"
+)
+
+const minRefreshInterval = 5 * time.Second
+
+// Config controls a single live capture run.
+type Config struct {
+	PlaylistURL string
+	OutFile     string
+	Headers     map[string]string
+	Retry       int
+
+	// Duration bounds how long to capture, zero means run until
+	// EXT-X-ENDLIST appears.
+	Duration time.Duration
+
+	// SkipSegments is how many segments to discard from the first
+	// fetched playlist before starting to download, so capture starts
+	// close to the live edge instead of at the start of the window.
+	SkipSegments int
+}
+
+// seenRing is a fixed-size ring buffer of recently-seen segment URIs,
+// used to dedupe segments across playlist refreshes without keeping an
+// unbounded history.
+type seenRing struct {
+	uris []string
+	set  map[string]bool
+	next int
+}
+
+func newSeenRing(size int) *seenRing {
+	return &seenRing{
+		uris: make([]string, size),
+		set:  make(map[string]bool, size),
+	}
+}
+
+func (r *seenRing) seen(uri string) bool {
+	return r.set[uri]
+}
+
+func (r *seenRing) add(uri string) {
+	if old := r.uris[r.next]; old != "" {
+		delete(r.set, old)
+	}
+	r.uris[r.next] = uri
+	r.set[uri] = true
+	r.next = (r.next + 1) % len(r.uris)
+}
+
+// Run captures a live stream per cfg until it ends or cfg.Duration
+// elapses, writing cleartext segment payloads to cfg.OutFile in the
+// order they appear on the playlist.
+func Run(client *zhttp.Zhttp, cfg Config) error {
+	out, err := os.OpenFile(cfg.OutFile, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	base, err := url.Parse(cfg.PlaylistURL)
+	if err != nil {
+		return err
+	}
+
+	seen := newSeenRing(1024)
+	keyCache := map[string][]byte{}
+	start := time.Now()
+	first := true
+
+	for {
+		if cfg.Duration > 0 && time.Since(start) >= cfg.Duration {
+			return nil
+		}
+
+		mpl, err := fetchPlaylist(client, cfg, base)
+		if err != nil {
+			return err
+		}
+
+		segments := pendingSegments(mpl, base)
+		if first {
+			if skip := cfg.SkipSegments; skip > 0 && skip < len(segments) {
+				for _, seg := range segments[:skip] {
+					seen.add(seg.URI)
+				}
+				segments = segments[skip:]
+			}
+			first = false
+		}
+
+		for _, seg := range segments {
+			if seen.seen(seg.URI) {
+				continue
+			}
+			seen.add(seg.URI)
+
+			if seg.Discontinuity {
+				// A discontinuity means the next segment may use a
+				// different codec/PMT configuration; nothing to flush
+				// here since we write raw TS payloads, but key state
+				// must not be carried across it.
+				keyCache = map[string][]byte{}
+			}
+
+			data, err := downloadSegment(client, cfg, seg, keyCache)
+			if err != nil {
+				return err
+			}
+
+			if _, err := out.Write(data); err != nil {
+				return err
+			}
+		}
+
+		if mpl.Closed {
+			return nil
+		}
+
+		wait := time.Duration(mpl.TargetDuration) * time.Second
+		if wait < minRefreshInterval {
+			wait = minRefreshInterval
+		}
+		time.Sleep(wait)
+	}
+}
+
+type pendingSegment struct {
+	URI           string
+	Key           *m3u8.Key
+	Discontinuity bool
+	SeqNo         uint64
+}
+
+func pendingSegments(mpl *m3u8.MediaPlaylist, base *url.URL) []pendingSegment {
+	segments := make([]pendingSegment, 0, mpl.Count())
+
+	count := int(mpl.Count())
+	for i := 0; i < count; i++ {
+		segment := mpl.Segments[i]
+		if segment == nil {
+			continue
+		}
+
+		uri, err := formatURI(base, segment.URI)
+		if err != nil {
+			continue
+		}
+
+		key := segment.Key
+		if key == nil {
+			key = mpl.Key
+		}
+
+		segments = append(segments, pendingSegment{
+			URI:           uri,
+			Key:           key,
+			Discontinuity: segment.Discontinuity,
+			SeqNo:         mpl.SeqNo + uint64(i),
+		})
+	}
+
+	return segments
+}
+
+func fetchPlaylist(client *zhttp.Zhttp, cfg Config, base *url.URL) (*m3u8.MediaPlaylist, error) {
+	statusCode, data, err := client.Get(base.String(), cfg.Headers, cfg.Retry)
+	if err != nil {
+		return nil, err
+	}
+	if statusCode/100 != 2 || len(data) == 0 {
+		return nil, errors.New("http code: " + strconv.Itoa(statusCode))
+	}
+
+	playlist, listType, err := m3u8.Decode(*bytes.NewBuffer(data), true)
+	if err != nil {
+		return nil, err
+	}
+	if listType != m3u8.MEDIA {
+		return nil, errors.New("--live requires a media playlist, got a master playlist")
+	}
+
+	return playlist.(*m3u8.MediaPlaylist), nil
+}
+
+func downloadSegment(client *zhttp.Zhttp, cfg Config, seg pendingSegment, keyCache map[string][]byte) ([]byte, error) {
+	statusCode, data, err := client.Get(seg.URI, cfg.Headers, cfg.Retry)
+	if err != nil {
+		return nil, err
+	}
+	if statusCode/100 != 2 || len(data) == 0 {
+		return nil, errors.New("http code: " + strconv.Itoa(statusCode))
+	}
+
+	if seg.Key == nil || seg.Key.URI == "" {
+		return data, nil
+	}
+
+	key, ok := keyCache[seg.Key.URI]
+	if !ok {
+		statusCode, key, err = client.Get(seg.Key.URI, cfg.Headers, cfg.Retry)
+		if err != nil {
+			return nil, err
+		}
+		if statusCode/100 != 2 || len(key) == 0 {
+			return nil, errors.New("http code: " + strconv.Itoa(statusCode))
+		}
+		keyCache[seg.Key.URI] = key
+	}
+
+	iv, err := resolveIV(seg.Key, seg.SeqNo)
+	if err != nil {
+		return nil, err
+	}
+
+	return decrypter.Decrypt(data, key, iv)
+}
+
+// resolveIV prefers the key's own IV attribute, falling back to the
+// segment's media sequence number per the HLS spec when EXT-X-KEY
+// carries none. Unlike main.go's resolveIV, it has no --iv override.
+func resolveIV(k *m3u8.Key, seqNo uint64) ([]byte, error) {
+	if k != nil && k.IV != "" {
+		return hex.DecodeString(strings.TrimPrefix(k.IV, "0x"))
+	}
+
+	iv := make([]byte, 16)
+	binary.BigEndian.PutUint64(iv[8:], seqNo)
+	return iv, nil
+}
+
+func formatURI(base *url.URL, u string) (string, error) {
+	if len(u) >= 4 && u[:4] == "http" {
+		return u, nil
+	}
+
+	obj, err := base.Parse(u)
+	if err != nil {
+		return "", err
+	}
+
+	return obj.String(), nil
+}
@@ -2,13 +2,17 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
 	"encoding/csv"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/url"
+	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
@@ -21,6 +25,9 @@ import (
 
 	"m3u8-downloader-go/decrypter"
 	"m3u8-downloader-go/joiner"
+	"m3u8-downloader-go/livedl"
+	"m3u8-downloader-go/muxer"
+	"m3u8-downloader-go/progress"
 	"m3u8-downloader-go/zhttp"
 )
 
@@ -30,8 +37,32 @@ var (
 	keyCache     = map[string][]byte{}
 	keyCacheLock sync.Mutex
 	headers      map[string]string
+
+	expectedHashes map[string]string
+
+	digestMu sync.Mutex
+	digests  map[string]string
+
+	reporter progress.Reporter
+
+	appLogger Logger = stdLogger{}
 )
 
+// Logger receives application log events. It exists so the plain
+// stdout/stderr logging below can be swapped out (e.g. for a JSON sink)
+// the same way progress.Reporter is, without touching every call site.
+type Logger interface {
+	Info(msg string, kv ...interface{})
+	Error(msg string, kv ...interface{})
+}
+
+// stdLogger is the default Logger, writing structured key=value lines
+// via the standard log package.
+type stdLogger struct{}
+
+func (stdLogger) Info(msg string, kv ...interface{})  { logEvent("info", msg, kv...) }
+func (stdLogger) Error(msg string, kv ...interface{}) { logEvent("error", msg, kv...) }
+
 type Conf struct {
 	URL       string        `clop:"-u; --url" usage:"url of m3u8 file"`
 	File      string        `clop:"-f; --m3u8-file" usage:"local m3u8 file"`
@@ -42,7 +73,45 @@ type Conf struct {
 	Proxy     string        `clop:"-p; --proxy" usage:"proxy. Example: http://127.0.0.1:8080"`
 	Headers   []string      `clop:"-H; --header; greedy" usage:"http header. Example: Referer:http://www.example.com"`
 	InFile    string        `clop:"-i; --in-file" usage:"input file with URLs"`
-	headers   map[string]string
+
+	MaxBandwidth uint32 `clop:"--max-bandwidth" usage:"pick the highest-bandwidth master playlist variant at or below this value"`
+	MinBandwidth uint32 `clop:"--min-bandwidth" usage:"pick the highest-bandwidth master playlist variant at or above this value"`
+	Resolution   string `clop:"--resolution" usage:"pick the master playlist variant matching this resolution, e.g. 1920x1080"`
+	VariantIndex int    `clop:"--variant-index" usage:"pick the master playlist variant by its index" default:"-1"`
+	Codec        string `clop:"--codec" usage:"pick the master playlist variant whose CODECS contains this substring"`
+	ListVariants bool   `clop:"--list-variants" usage:"list the variants of a master playlist and exit"`
+
+	Live             bool          `clop:"--live" usage:"capture a live HLS stream instead of downloading a VOD playlist once"`
+	LiveDuration     time.Duration `clop:"--duration" usage:"stop live capture after this long, zero means until EXT-X-ENDLIST"`
+	LiveSkipSegments int           `clop:"--skip-live-segments" usage:"segments to discard from the first playlist fetch before capturing, to start near the live edge" default:"3"`
+
+	Force bool `clop:"--force" usage:"ignore any existing checkpoint and download from scratch"`
+
+	Format    string `clop:"--format" usage:"output format: ts, mp4, mkv or aac-extract" default:"ts"`
+	AudioOnly bool   `clop:"--audio-only" usage:"extract the AAC audio track only, ignoring --format"`
+
+	KeyFile string `clop:"--key-file" usage:"read the decryption key from this file instead of fetching the key URI"`
+	KeyHex  string `clop:"--key-hex" usage:"use this hex-encoded decryption key instead of fetching the key URI"`
+	IV      string `clop:"--iv" usage:"override the IV used for decryption instead of the one in EXT-X-KEY"`
+
+	VerifySHA256 string `clop:"--verify-sha256" usage:"CSV or JSON file of expected segment URI -> sha256 digest, fails a segment on mismatch"`
+
+	Progress string `clop:"--progress" usage:"progress output: bar, json or none" default:"none"`
+
+	headers map[string]string
+}
+
+// logEvent writes a structured, key=value style log line, so downloads
+// can be grepped/parsed without needing --progress=json.
+func logEvent(level, msg string, kv ...interface{}) {
+	var b strings.Builder
+	b.WriteString(level)
+	b.WriteByte(' ')
+	b.WriteString(msg)
+	for i := 0; i+1 < len(kv); i += 2 {
+		fmt.Fprintf(&b, " %v=%v", kv[i], kv[i+1])
+	}
+	log.Println(b.String())
 }
 
 func main() {
@@ -66,31 +135,75 @@ func main() {
 	}
 
 	var err error
+	reporter, err = progress.New(conf.Progress)
+	if err != nil {
+		appLogger.Error("progress reporter init failed", "err", err)
+		os.Exit(1)
+	}
+
 	ZHTTP, err = zhttp.New(conf.Timeout, conf.Proxy)
 	if err != nil {
-		log.Fatalln("[-] Init failed:", err)
+		appLogger.Error("http client init failed", "err", err)
+		os.Exit(1)
+	}
+
+	if conf.VerifySHA256 != "" {
+		expectedHashes, err = loadExpectedHashes(conf.VerifySHA256)
+		if err != nil {
+			appLogger.Error("load verify-sha256 file failed", "err", err)
+			os.Exit(1)
+		}
+	}
+
+	if conf.Live {
+		outFile := conf.OutFile
+		if outFile == "" {
+			outFile = "live.ts"
+		}
+
+		cfg := livedl.Config{
+			PlaylistURL:  conf.URL,
+			OutFile:      outFile,
+			Headers:      conf.headers,
+			Retry:        conf.Retry,
+			Duration:     conf.LiveDuration,
+			SkipSegments: conf.LiveSkipSegments,
+		}
+
+		appLogger.Info("starting live capture", "file", outFile)
+		if err := livedl.Run(ZHTTP, cfg); err != nil {
+			appLogger.Error("live capture failed", "err", err)
+			os.Exit(1)
+		}
+		appLogger.Info("live capture finished", "file", outFile)
+
+		return
 	}
 
 	if conf.InFile != "" {
 		m3u8Files, err := processInFile(conf.InFile)
 		if err != nil {
-			log.Fatalln("[-] Failed to process input file:", err)
+			appLogger.Error("process input file failed", "err", err)
+			os.Exit(1)
 		}
 
 		for name, mediaURL := range m3u8Files {
 			m3u8File, err := downloadM3u8(mediaURL)
 			if err != nil {
-				log.Fatalln("[-] Download m3u8 file failed:", err)
+				appLogger.Error("download m3u8 file failed", "file", name, "err", err)
+				continue
 			}
 
 			mpl, err := parseM3u8(m3u8File)
 			if err != nil {
-				log.Fatalln("[-] Parse m3u8 file failed:", err)
-			} else {
-				log.Println("[+] Parse m3u8 file succeed")
+				appLogger.Error("parse m3u8 file failed", "file", name, "err", err)
+				continue
 			}
+			appLogger.Info("parse m3u8 file succeeded", "file", name)
 
-			downloadFile(mpl, name)
+			if err := downloadFile(mpl, name); err != nil {
+				appLogger.Error("download failed", "file", name, "err", err)
+			}
 		}
 
 		return
@@ -100,21 +213,23 @@ func main() {
 	if conf.File != "" {
 		m3u8File, err = ioutil.ReadFile(conf.File)
 		if err != nil {
-			log.Fatalln("[-] Load m3u8 file failed:", err)
+			appLogger.Error("load m3u8 file failed", "err", err)
+			os.Exit(1)
 		}
 	} else {
 		m3u8File, err = downloadM3u8(conf.URL)
 		if err != nil {
-			log.Fatalln("[-] Download m3u8 file failed:", err)
+			appLogger.Error("download m3u8 file failed", "err", err)
+			os.Exit(1)
 		}
 	}
 
 	mpl, err := parseM3u8(m3u8File)
 	if err != nil {
-		log.Fatalln("[-] Parse m3u8 file failed:", err)
-	} else {
-		log.Println("[+] Parse m3u8 file succeed")
+		appLogger.Error("parse m3u8 file failed", "err", err)
+		os.Exit(1)
 	}
+	appLogger.Info("parse m3u8 file succeeded")
 
 	outFile := conf.OutFile
 	if outFile == "" {
@@ -122,7 +237,10 @@ func main() {
 
 	}
 
-	downloadFile(mpl, outFile)
+	if err := downloadFile(mpl, outFile); err != nil {
+		appLogger.Error("download failed", "err", err)
+		os.Exit(1)
+	}
 }
 
 func processInFile(file string) (map[string]string, error) {
@@ -145,25 +263,115 @@ func processInFile(file string) (map[string]string, error) {
 	return urls, nil
 }
 
-func downloadFile(mpl *m3u8.MediaPlaylist, outFile string) {
-	joiner, err := joiner.New(outFile)
+// loadExpectedHashes reads a --verify-sha256 file mapping segment URI
+// to expected sha256 digest, accepting either a JSON object or a
+// two-column CSV file.
+func loadExpectedHashes(path string) (map[string]string, error) {
+	raw, err := ioutil.ReadFile(path)
 	if err != nil {
-		log.Fatalln("[-] Open file failed:", err)
-	} else {
-		log.Println("[+] Will save to", joiner.Name())
+		return nil, err
+	}
+
+	hashes := map[string]string{}
+	if err := json.Unmarshal(raw, &hashes); err == nil {
+		return hashes, nil
+	}
+
+	records, err := csv.NewReader(bytes.NewReader(raw)).ReadAll()
+	if err != nil {
+		return nil, errors.New("--verify-sha256 file is neither valid JSON nor CSV: " + err.Error())
+	}
+	for _, record := range records {
+		if len(record) < 2 {
+			continue
+		}
+		hashes[record[0]] = record[1]
+	}
+
+	return hashes, nil
+}
+
+// writeDigestManifest emits the sha256 digest computed for every
+// segment downloaded in this run to outFile.sha256.json, so downstream
+// consumers can verify integrity independently. Segments already
+// completed by an earlier, resumed run are not included.
+func writeDigestManifest(outFile string) error {
+	digestMu.Lock()
+	defer digestMu.Unlock()
+
+	data, err := json.MarshalIndent(digests, "", "  ")
+	if err != nil {
+		return err
 	}
 
-	if mpl.Count() > 0 {
-		log.Println("[+] Total", mpl.Count(), "files to download")
+	return ioutil.WriteFile(outFile+".sha256.json", data, 0644)
+}
 
-		start(joiner, mpl)
+func downloadFile(mpl *m3u8.MediaPlaylist, outFile string) error {
+	remux := conf.AudioOnly || conf.Format != "ts"
 
-		err = joiner.Run(int(mpl.Count()))
+	tsFile := outFile
+	if remux {
+		tsFile = outFile + ".ts.tmp"
+	}
+
+	count := int(mpl.Count())
+	uris := make([]string, count)
+	for i := 0; i < count; i++ {
+		uris[i] = mpl.Segments[i].URI
+	}
+	playlistHash := joiner.HashPlaylist(uris)
+
+	digestMu.Lock()
+	digests = map[string]string{}
+	digestMu.Unlock()
+
+	j, completed, err := joiner.NewResumable(tsFile, playlistHash, conf.Force)
+	if err != nil {
+		return fmt.Errorf("open file failed: %w", err)
+	}
+	appLogger.Info("will save to", "file", j.Name())
+	if len(completed) > 0 {
+		appLogger.Info("resuming download", "completed", len(completed))
+	}
+
+	if count > 0 {
+		appLogger.Info("total files to download", "count", count)
+
+		reporter.Start(j.Name(), count)
+		start(j, mpl, completed)
+
+		err := j.Run(count)
+		reporter.Done(j.Name())
 		if err != nil {
-			log.Fatalln("[-] Write to file failed:", err)
+			return fmt.Errorf("download incomplete: %w", err)
 		}
-		log.Println("[+] Download succeed, saved to", joiner.Name())
+		appLogger.Info("download succeeded", "file", j.Name())
+
+		if err := writeDigestManifest(outFile); err != nil {
+			appLogger.Error("write sha256 manifest failed", "err", err)
+		}
+	}
+
+	if !remux {
+		return nil
 	}
+
+	appLogger.Info("remuxing", "file", outFile)
+
+	if conf.AudioOnly || conf.Format == "aac-extract" {
+		err = muxer.ExtractAAC(tsFile, outFile)
+	} else {
+		err = muxer.Remux(tsFile, outFile, conf.Format)
+	}
+	if err != nil {
+		return fmt.Errorf("remux failed: %w", err)
+	}
+
+	os.Remove(tsFile)
+	appLogger.Info("saved", "file", outFile)
+
+	return nil
 }
 
 func checkConf() {
@@ -172,6 +380,18 @@ func checkConf() {
 		clop.Usage()
 	}
 
+	if conf.Live && conf.URL == "" {
+		fmt.Println("--live requires -u")
+		clop.Usage()
+	}
+
+	switch conf.Format {
+	case "ts", "mp4", "mkv", "aac-extract":
+	default:
+		fmt.Println("--format must be one of: ts, mp4, mkv, aac-extract")
+		clop.Usage()
+	}
+
 	if conf.ThreadNum <= 0 {
 		conf.ThreadNum = 10
 	}
@@ -185,13 +405,21 @@ func checkConf() {
 	}
 }
 
-func start(joiner *joiner.Joiner, mpl *m3u8.MediaPlaylist) {
+func start(j *joiner.Joiner, mpl *m3u8.MediaPlaylist, completed []int) {
+	skip := make(map[int]bool, len(completed))
+	for _, id := range completed {
+		skip[id] = true
+	}
+
 	pool := hackpool.New(conf.ThreadNum, download)
 
 	go func() {
 		var count = int(mpl.Count())
 		for i := 0; i < count; i++ {
-			pool.Push(i, mpl.Segments[i], mpl.Key, joiner)
+			if skip[i] {
+				continue
+			}
+			pool.Push(i, mpl.Segments[i], mpl.Key, j)
 		}
 		pool.CloseQueue()
 	}()
@@ -218,15 +446,59 @@ func parseM3u8(data []byte) (*m3u8.MediaPlaylist, error) {
 		return nil, err
 	}
 
-	if listType == m3u8.MEDIA {
-		var obj *url.URL
-		if conf.URL != "" {
-			obj, err = url.Parse(conf.URL)
-			if err != nil {
-				return nil, errors.New("parse m3u8 url failed: " + err.Error())
+	var obj *url.URL
+	if conf.URL != "" {
+		obj, err = url.Parse(conf.URL)
+		if err != nil {
+			return nil, errors.New("parse m3u8 url failed: " + err.Error())
+		}
+	}
+
+	if listType == m3u8.MASTER {
+		master := playlist.(*m3u8.MasterPlaylist)
+
+		if conf.ListVariants {
+			listVariants(obj, master)
+			os.Exit(0)
+		}
+
+		variant, err := selectVariant(master)
+		if err != nil {
+			return nil, err
+		}
+
+		variantURL, err := formatURI(obj, variant.URI)
+		if err != nil {
+			return nil, err
+		}
+		appLogger.Info("selected variant", "url", variantURL)
+
+		variantFile, err := downloadM3u8(variantURL)
+		if err != nil {
+			return nil, errors.New("download variant playlist failed: " + err.Error())
+		}
+
+		conf.URL = variantURL
+		mpl, err := parseM3u8(variantFile)
+		if err != nil {
+			return nil, err
+		}
+
+		if mpl.Key == nil {
+			if sessionKey := parseSessionKey(data); sessionKey != nil {
+				uri, err := formatURI(obj, sessionKey.URI)
+				if err != nil {
+					return nil, err
+				}
+				sessionKey.URI = uri
+				mpl.Key = sessionKey
 			}
 		}
 
+		return mpl, nil
+	}
+
+	if listType == m3u8.MEDIA {
 		mpl := playlist.(*m3u8.MediaPlaylist)
 
 		if mpl.Key != nil && mpl.Key.URI != "" {
@@ -264,16 +536,103 @@ func parseM3u8(data []byte) (*m3u8.MediaPlaylist, error) {
 	return nil, errors.New("unsupported m3u8 type")
 }
 
-func getKey(url string) ([]byte, error) {
+// selectVariant picks one variant out of a master playlist according to
+// the --max-bandwidth, --min-bandwidth, --resolution, --variant-index
+// and --codec flags. With nothing set, it falls back to the
+// highest-bandwidth variant, which is usually the best quality available.
+func selectVariant(master *m3u8.MasterPlaylist) (*m3u8.Variant, error) {
+	if len(master.Variants) == 0 {
+		return nil, errors.New("master playlist has no variants")
+	}
+
+	if conf.VariantIndex >= 0 {
+		if conf.VariantIndex >= len(master.Variants) {
+			return nil, fmt.Errorf("variant index %d out of range, playlist has %d variants", conf.VariantIndex, len(master.Variants))
+		}
+		return master.Variants[conf.VariantIndex], nil
+	}
+
+	var best *m3u8.Variant
+	for _, variant := range master.Variants {
+		if conf.Resolution != "" && variant.Resolution != conf.Resolution {
+			continue
+		}
+		if conf.Codec != "" && !strings.Contains(variant.Codecs, conf.Codec) {
+			continue
+		}
+		if conf.MaxBandwidth > 0 && variant.Bandwidth > conf.MaxBandwidth {
+			continue
+		}
+		if conf.MinBandwidth > 0 && variant.Bandwidth < conf.MinBandwidth {
+			continue
+		}
+
+		if best == nil || variant.Bandwidth > best.Bandwidth {
+			best = variant
+		}
+	}
+
+	if best == nil {
+		return nil, errors.New("no variant matches the given --max-bandwidth/--min-bandwidth/--resolution/--codec filters")
+	}
+
+	return best, nil
+}
+
+// listVariants prints every variant of a master playlist, resolved
+// against the master URL, without downloading anything.
+func listVariants(base *url.URL, master *m3u8.MasterPlaylist) {
+	for i, variant := range master.Variants {
+		uri, err := formatURI(base, variant.URI)
+		if err != nil {
+			uri = variant.URI
+		}
+
+		var groups []string
+		for _, alt := range variant.Alternatives {
+			groups = append(groups, alt.GroupId+":"+alt.Type)
+		}
+
+		fmt.Printf("[%d] bandwidth=%d resolution=%s codecs=%s", i, variant.Bandwidth, variant.Resolution, variant.Codecs)
+		if len(groups) > 0 {
+			fmt.Printf(" groups=%s", strings.Join(groups, ","))
+		}
+		fmt.Printf(" uri=%s\n", uri)
+	}
+}
+
+// keyCacheKey builds the keyCache index for a key. Segment-level
+// EXT-X-KEY tags can legitimately rotate the key mid-playlist, so the
+// URI alone isn't enough to identify a cached key: two segments can
+// point at the same URI under different METHOD/KEYFORMAT and must not
+// collide.
+func keyCacheKey(k *m3u8.Key) string {
+	return k.URI + "|" + k.Method + "|" + k.Keyformat
+}
+
+func getKey(k *m3u8.Key) ([]byte, error) {
+	if conf.KeyHex != "" {
+		return hex.DecodeString(conf.KeyHex)
+	}
+
+	if conf.KeyFile != "" {
+		return ioutil.ReadFile(conf.KeyFile)
+	}
+
+	if k.Keyformat != "" && !strings.EqualFold(k.Keyformat, "identity") {
+		return nil, errors.New("unsupported KEYFORMAT: " + k.Keyformat)
+	}
+
+	cacheKey := keyCacheKey(k)
+
 	keyCacheLock.Lock()
 	defer keyCacheLock.Unlock()
 
-	key := keyCache[url]
-	if key != nil {
+	if key := keyCache[cacheKey]; key != nil {
 		return key, nil
 	}
 
-	statusCode, key, err := ZHTTP.Get(url, headers, conf.Retry)
+	statusCode, key, err := ZHTTP.Get(k.URI, headers, conf.Retry)
 	if err != nil {
 		return nil, err
 	}
@@ -282,60 +641,108 @@ func getKey(url string) ([]byte, error) {
 		return nil, errors.New("http code: " + strconv.Itoa(statusCode))
 	}
 
-	keyCache[url] = key
+	keyCache[cacheKey] = key
 
 	return key, nil
 }
 
+// resolveIV returns the IV to use for segment id, preferring an
+// explicit --iv override, then the key's own IV attribute, falling
+// back to the segment index per the HLS spec.
+func resolveIV(k *m3u8.Key, id int) ([]byte, error) {
+	ivStr := conf.IV
+	if ivStr == "" {
+		ivStr = k.IV
+	}
+	if ivStr == "" {
+		iv := make([]byte, 16)
+		binary.BigEndian.PutUint64(iv[8:], uint64(id))
+		return iv, nil
+	}
+
+	return hex.DecodeString(strings.TrimPrefix(ivStr, "0x"))
+}
+
 func download(args ...interface{}) {
 	id := args[0].(int)
 	segment := args[1].(*m3u8.MediaSegment)
 	globalKey := args[2].(*m3u8.Key)
-	joiner := args[3].(*joiner.Joiner)
+	j := args[3].(*joiner.Joiner)
 
-	statusCode, data, err := ZHTTP.Get(segment.URI, headers, conf.Retry)
+	statusCode, data, err := ZHTTP.GetRange(segment.URI, headers, conf.Retry, segment.Offset, segment.Limit)
 	if err != nil {
-		log.Fatalln("[-] Download failed:", id, err)
+		appLogger.Error("download failed", "segment", id, "err", err)
+		reporter.Error(j.Name(), id, err)
+		j.Fail(id, err)
+		return
 	}
 
 	if statusCode/100 != 2 || len(data) == 0 {
-		log.Fatalln("[-] Download failed, http code:", statusCode)
+		err := errors.New("http code: " + strconv.Itoa(statusCode))
+		appLogger.Error("download failed", "segment", id, "err", err)
+		reporter.Error(j.Name(), id, err)
+		j.Fail(id, err)
+		return
 	}
 
-	var keyURL, ivStr string
+	var k *m3u8.Key
 	if segment.Key != nil && segment.Key.URI != "" {
-		keyURL = segment.Key.URI
-		ivStr = segment.Key.IV
+		k = segment.Key
 	} else if globalKey != nil && globalKey.URI != "" {
-		keyURL = globalKey.URI
-		ivStr = globalKey.IV
+		k = globalKey
 	}
 
-	if keyURL != "" {
-		var key, iv []byte
-		key, err = getKey(keyURL)
+	if k != nil && !strings.EqualFold(k.Method, "NONE") {
+		key, err := getKey(k)
 		if err != nil {
-			log.Fatalln("[-] Download key failed:", keyURL, err)
+			appLogger.Error("download key failed", "segment", id, "key_uri", k.URI, "err", err)
+			reporter.Error(j.Name(), id, err)
+			j.Fail(id, err)
+			return
 		}
 
-		if ivStr != "" {
-			iv, err = hex.DecodeString(strings.TrimPrefix(ivStr, "0x"))
-			if err != nil {
-				log.Fatalln("[-] Decode iv failed:", err)
-			}
-		} else {
-			iv = []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, byte(id)}
+		iv, err := resolveIV(k, id)
+		if err != nil {
+			appLogger.Error("decode iv failed", "segment", id, "err", err)
+			reporter.Error(j.Name(), id, err)
+			j.Fail(id, err)
+			return
 		}
 
-		data, err = decrypter.Decrypt(data, key, iv)
+		if strings.EqualFold(k.Method, "SAMPLE-AES") {
+			data, err = decrypter.DecryptSampleAES(data, key, iv)
+		} else {
+			data, err = decrypter.Decrypt(data, key, iv)
+		}
 		if err != nil {
-			log.Fatalln("[-] Decrypt failed:", err)
+			appLogger.Error("decrypt failed", "segment", id, "err", err)
+			reporter.Error(j.Name(), id, err)
+			j.Fail(id, err)
+			return
 		}
 	}
 
-	log.Println("[+] Download succeed:", id, segment.URI)
+	sum := sha256.Sum256(data)
+	digest := hex.EncodeToString(sum[:])
+
+	if expectedHashes != nil {
+		if want, ok := expectedHashes[segment.URI]; ok && !strings.EqualFold(want, digest) {
+			err := fmt.Errorf("sha256 mismatch for %s: want %s, got %s", segment.URI, want, digest)
+			appLogger.Error("verify failed", "segment", id, "err", err)
+			reporter.Error(j.Name(), id, err)
+			j.Fail(id, err)
+			return
+		}
+	}
+
+	digestMu.Lock()
+	digests[segment.URI] = digest
+	digestMu.Unlock()
+
+	appLogger.Info("download succeeded", "segment", id, "uri", segment.URI)
+	reporter.Segment(j.Name(), id, int64(len(data)))
 
-	joiner.Join(id, data)
+	j.Join(id, data)
 }
 
 func formatURI(base *url.URL, u string) (string, error) {
@@ -355,6 +762,40 @@ func formatURI(base *url.URL, u string) (string, error) {
 	return obj.String(), nil
 }
 
+// parseSessionKey scans a master playlist's raw bytes for an
+// EXT-X-SESSION-KEY tag and returns it as a *m3u8.Key, since grafov/m3u8
+// does not expose master-level keys directly.
+func parseSessionKey(data []byte) *m3u8.Key {
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "#EXT-X-SESSION-KEY:") {
+			continue
+		}
+
+		attrs := parseAttributeList(strings.TrimPrefix(line, "#EXT-X-SESSION-KEY:"))
+		return &m3u8.Key{
+			Method:    attrs["METHOD"],
+			URI:       attrs["URI"],
+			IV:        attrs["IV"],
+			Keyformat: attrs["KEYFORMAT"],
+		}
+	}
+
+	return nil
+}
+
+func parseAttributeList(s string) map[string]string {
+	attrs := map[string]string{}
+	for _, part := range strings.Split(s, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		attrs[kv[0]] = strings.Trim(kv[1], `"`)
+	}
+	return attrs
+}
+
 func filename(u string) string {
 	obj, _ := url.Parse(u)
 	_, filename := filepath.Split(obj.Path)
@@ -0,0 +1,92 @@
+// Package muxer turns the raw, concatenated MPEG-TS file produced by the
+// joiner into the container format the user asked for via --format.
+// "ts" needs no work; mp4 and mkv are produced by shelling out to
+// ffmpeg, and aac-extract demuxes the AAC elementary stream directly.
+package muxer
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+
+	"github.com/asticode/go-astits"
+)
+
+// Remux converts the TS file at tsPath into outFile according to
+// format. It is only meaningful for formats other than "ts", which the
+// caller handles by not remuxing at all.
+func Remux(tsPath, outFile, format string) error {
+	switch format {
+	case "mp4", "mkv":
+		return ffmpegRemux(tsPath, outFile)
+	default:
+		return fmt.Errorf("unsupported output format: %s", format)
+	}
+}
+
+// ExtractAAC pulls the raw AAC ADTS elementary stream out of the TS file
+// at tsPath and writes it to outFile, ignoring every other stream.
+func ExtractAAC(tsPath, outFile string) error {
+	in, err := os.Open(tsPath)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(outFile)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	dmx := astits.NewDemuxer(context.Background(), in)
+
+	var audioPID uint16
+	haveAudioPID := false
+
+	for {
+		data, err := dmx.NextData()
+		if err != nil {
+			if err == astits.ErrNoMorePackets {
+				break
+			}
+			return err
+		}
+
+		if data.PMT != nil {
+			for _, es := range data.PMT.ElementaryStreams {
+				if es.StreamType == astits.StreamTypeAACAudio {
+					audioPID = es.ElementaryPID
+					haveAudioPID = true
+					break
+				}
+			}
+		}
+
+		if data.PES != nil && haveAudioPID && data.PID == audioPID {
+			if _, err := out.Write(data.PES.Data); err != nil {
+				return err
+			}
+		}
+	}
+
+	if !haveAudioPID {
+		return fmt.Errorf("no AAC audio stream found in %s", tsPath)
+	}
+
+	return nil
+}
+
+func ffmpegRemux(tsPath, outFile string) error {
+	ffmpegPath, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		return fmt.Errorf("ffmpeg not found in PATH, required for this --format: %w", err)
+	}
+
+	cmd := exec.Command(ffmpegPath, "-y", "-i", tsPath, "-c", "copy", outFile)
+	cmd.Stderr = os.Stderr
+	cmd.Stdout = os.Stdout
+
+	return cmd.Run()
+}
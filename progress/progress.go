@@ -0,0 +1,152 @@
+// Package progress reports download progress to the user. Selecting a
+// Reporter lets the same download loop drive a terminal bar, emit
+// NDJSON events for another process to consume, or stay silent.
+package progress
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Reporter receives progress updates as a download proceeds.
+// Implementations must be safe for concurrent use, since segments
+// download in parallel.
+type Reporter interface {
+	Start(file string, segments int)
+	Segment(file string, id int, bytes int64)
+	Error(file string, id int, err error)
+	Done(file string)
+}
+
+// New builds the Reporter selected by --progress: "bar", "json" or
+// "none".
+func New(kind string) (Reporter, error) {
+	switch kind {
+	case "", "none":
+		return noneReporter{}, nil
+	case "bar":
+		return &barReporter{states: map[string]*barState{}}, nil
+	case "json":
+		return &jsonReporter{enc: json.NewEncoder(os.Stdout)}, nil
+	default:
+		return nil, fmt.Errorf("unknown --progress value: %s", kind)
+	}
+}
+
+type noneReporter struct{}
+
+func (noneReporter) Start(string, int)          {}
+func (noneReporter) Segment(string, int, int64) {}
+func (noneReporter) Error(string, int, error)   {}
+func (noneReporter) Done(string)                {}
+
+type event struct {
+	Type      string `json:"type"`
+	File      string `json:"file"`
+	SegmentID int    `json:"segment_id,omitempty"`
+	Segments  int    `json:"segments,omitempty"`
+	Bytes     int64  `json:"bytes,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+type jsonReporter struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func (r *jsonReporter) emit(e event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.enc.Encode(e)
+}
+
+func (r *jsonReporter) Start(file string, segments int) {
+	r.emit(event{Type: "start", File: file, Segments: segments})
+}
+
+func (r *jsonReporter) Segment(file string, id int, bytes int64) {
+	r.emit(event{Type: "segment", File: file, SegmentID: id, Bytes: bytes})
+}
+
+func (r *jsonReporter) Error(file string, id int, err error) {
+	r.emit(event{Type: "error", File: file, SegmentID: id, Error: err.Error()})
+}
+
+func (r *jsonReporter) Done(file string) {
+	r.emit(event{Type: "done", File: file})
+}
+
+// barState tracks one file's progress for barReporter, which renders
+// one bar per file so batch (-i) downloads stay readable.
+type barState struct {
+	total     int
+	completed int
+	bytes     int64
+	start     time.Time
+}
+
+type barReporter struct {
+	mu     sync.Mutex
+	states map[string]*barState
+}
+
+func (r *barReporter) Start(file string, segments int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.states[file] = &barState{total: segments, start: time.Now()}
+}
+
+func (r *barReporter) Segment(file string, id int, bytes int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s := r.states[file]
+	if s == nil {
+		return
+	}
+	s.completed++
+	s.bytes += bytes
+	r.render(file, s)
+}
+
+func (r *barReporter) Error(file string, id int, err error) {
+	fmt.Fprintf(os.Stderr, "\n[-] %s segment %d failed: %v\n", file, id, err)
+}
+
+func (r *barReporter) Done(file string) {
+	r.mu.Lock()
+	delete(r.states, file)
+	r.mu.Unlock()
+	fmt.Println()
+}
+
+func (r *barReporter) render(file string, s *barState) {
+	const width = 30
+
+	ratio := float64(s.completed) / float64(s.total)
+	filled := int(ratio * width)
+
+	elapsed := time.Since(s.start).Seconds()
+	throughput := float64(s.bytes) / maxFloat(elapsed, 0.001)
+	eta := float64(s.total-s.completed) * (elapsed / maxFloat(float64(s.completed), 1))
+
+	fmt.Printf("\r%s [%s%s] %d/%d %.1f KB/s ETA %.0fs",
+		file,
+		strings.Repeat("=", filled),
+		strings.Repeat(" ", width-filled),
+		s.completed, s.total,
+		throughput/1024,
+		eta,
+	)
+}
+
+func maxFloat(a, b float64) float64 {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,96 @@
+// Package zhttp is a small HTTP client wrapper used for every fetch in
+// this tool: it adds retries, optional proxying, and the byte-range
+// requests needed for EXT-X-BYTERANGE segments.
+package zhttp
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Zhttp is a retrying HTTP client with an optional proxy.
+type Zhttp struct {
+	client *http.Client
+}
+
+// New builds a Zhttp client with the given timeout and optional proxy
+// URL. An empty proxy disables proxying.
+func New(timeout time.Duration, proxy string) (*Zhttp, error) {
+	transport := &http.Transport{}
+
+	if proxy != "" {
+		proxyURL, err := url.Parse(proxy)
+		if err != nil {
+			return nil, err
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	return &Zhttp{
+		client: &http.Client{
+			Timeout:   timeout,
+			Transport: transport,
+		},
+	}, nil
+}
+
+// Get fetches u, making up to retry attempts in all and trying again
+// only after a transport error.
+func (z *Zhttp) Get(u string, headers map[string]string, retry int) (int, []byte, error) {
+	return z.GetRange(u, headers, retry, 0, 0)
+}
+
+// GetRange fetches u like Get, but sends a Range header when limit is
+// greater than zero, as required for segments using EXT-X-BYTERANGE. A
+// ranged request that doesn't come back 206 Partial Content is treated
+// as an error.
+func (z *Zhttp) GetRange(u string, headers map[string]string, retry int, offset, limit int64) (statusCode int, data []byte, err error) {
+	if retry <= 0 {
+		retry = 1
+	}
+
+	for i := 0; i < retry; i++ {
+		statusCode, data, err = z.doGet(u, headers, offset, limit)
+		if err == nil {
+			return statusCode, data, nil
+		}
+	}
+
+	return statusCode, data, err
+}
+
+func (z *Zhttp) doGet(u string, headers map[string]string, offset, limit int64) (int, []byte, error) {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	ranged := limit > 0
+	if ranged {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+limit-1))
+	}
+
+	resp, err := z.client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+
+	if ranged && resp.StatusCode != http.StatusPartialContent {
+		return resp.StatusCode, nil, fmt.Errorf("expected 206 Partial Content for ranged request, got %d", resp.StatusCode)
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, nil, err
+	}
+
+	return resp.StatusCode, data, nil
+}